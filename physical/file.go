@@ -1,12 +1,17 @@
 package physical
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io"
+	"hash/fnv"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -14,19 +19,86 @@ import (
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/helper/jsonutil"
+	"github.com/hashicorp/vault/physical/fs"
 )
 
 // FileBackend is a physical backend that stores data on disk
 // at a given file path. It can be used for durable single server
 // situations, or to develop locally where durability is not critical.
 //
-// WARNING: the file backend implementation is currently extremely unsafe
-// and non-performant. It is meant mostly for local testing and development.
-// It can be improved in the future.
+// WARNING: the file backend implementation is currently non-performant.
+// Writes are made crash-safe via a temp-file-plus-rename, but it is meant
+// mostly for local testing and development. It can be improved in the
+// future.
 type FileBackend struct {
-	Path   string
-	l      sync.Mutex
-	logger log.Logger
+	Path string
+	// locks stripes Get/Put/Delete locking by key so unrelated keys don't
+	// serialize behind each other. dirLock guards the directory tree itself
+	// (creation in Put, cleanup in cleanupLogicalPath) against concurrent
+	// List calls walking it.
+	locks   [numLockShards]sync.Mutex
+	dirLock sync.RWMutex
+	fs      fs.FS
+	logger  log.Logger
+	// id is the random identifier read from (or written to) the ID file in
+	// metaDir the first time this directory was opened as a FileBackend.
+	id string
+}
+
+const (
+	// fileBackendVersion1 is the original on-disk format: entries are plain
+	// JSON, and some file names predate base64 encoding.
+	fileBackendVersion1 = 1
+	// fileBackendVersion2 is the current on-disk format: file names are
+	// base64-encoded and entries are wrapped in a sha256-checksummed envelope.
+	fileBackendVersion2 = 2
+
+	currentFileBackendVersion = fileBackendVersion2
+)
+
+// metaDir is a reserved directory name, directly under Path, that holds the
+// VERSION and ID files rather than a logical entry. List and Verify skip it
+// so it never shows up as a bogus key in the logical keyspace.
+const metaDir = ".vault"
+
+// tmpFileInfix marks the temp files Put writes before renaming them into
+// place. It's distinctive enough that List/Verify can recognize and skip a
+// leftover one if a crash happened between creating it and the rename.
+const tmpFileInfix = ".tmp-"
+
+// numLockShards is the number of stripes in the per-key lock table. Keys are
+// assigned to a shard by hashing, so operations on distinct keys can proceed
+// without blocking on each other while updates to the same key remain
+// serialized.
+const numLockShards = 256
+
+// lockFor returns the shard of the lock table responsible for path. Calls
+// for the same path always map to the same shard, so locking it serializes
+// all operations against that key.
+func (b *FileBackend) lockFor(path string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	return &b.locks[h.Sum32()%numLockShards]
+}
+
+// fileEntry is the on-disk envelope Put writes and Get reads. SHA256 is the
+// hex-encoded checksum of Entry, computed over the exact bytes stored in
+// Entry, so that Get can detect corruption (bit-rot, a partial write the
+// filesystem didn't catch, an operator edit) instead of silently handing
+// back whatever bytes happen to be on disk.
+type fileEntry struct {
+	SHA256 string          `json:"sha256"`
+	Entry  json.RawMessage `json:"entry"`
+}
+
+// ErrCorrupt is returned by Get and Verify when a stored entry's checksum
+// does not match its content.
+type ErrCorrupt struct {
+	Key string
+}
+
+func (e *ErrCorrupt) Error() string {
+	return fmt.Sprintf("physical: entry at %q is corrupt: checksum mismatch", e.Key)
 }
 
 // newFileBackend constructs a Filebackend using the given directory
@@ -36,10 +108,102 @@ func newFileBackend(conf map[string]string, logger log.Logger) (Backend, error)
 		return nil, fmt.Errorf("'path' must be set")
 	}
 
-	return &FileBackend{
+	b := &FileBackend{
 		Path:   path,
+		fs:     fs.New(),
 		logger: logger,
-	}, nil
+	}
+
+	if err := b.fs.MkdirAll(filepath.Join(path, metaDir), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %q: %v", path, err)
+	}
+
+	id, err := b.loadOrCreateRepositoryMetadata()
+	if err != nil {
+		return nil, err
+	}
+	b.id = id
+
+	logger.Info("physical/file: opened storage directory", "path", path, "id", id)
+
+	return b, nil
+}
+
+// loadOrCreateRepositoryMetadata reads the VERSION and ID files under
+// metaDir, creating them on first use. VERSION lets a future on-disk format
+// change refuse to start against data it doesn't understand, instead of
+// silently misreading it; ID is a random identifier operators can log and
+// compare to catch a server accidentally pointed at the wrong storage
+// directory.
+//
+// A missing VERSION file has always meant fileBackendVersion1 (the original,
+// non-encoded, unframed format) — that's what every entry already on disk in
+// such a directory actually is — so that's the value written the first time
+// this directory is opened, not currentFileBackendVersion. Individual
+// entries only become fileBackendVersion2 once Put rewrites them; VERSION is
+// bumped once Get and Verify no longer need to understand the older format.
+func (b *FileBackend) loadOrCreateRepositoryMetadata() (string, error) {
+	versionPath := filepath.Join(b.Path, metaDir, "VERSION")
+	version, err := b.readOrCreateFile(versionPath, strconv.Itoa(fileBackendVersion1))
+	if err != nil {
+		return "", fmt.Errorf("physical/file: failed to read %q: %v", versionPath, err)
+	}
+
+	versionNum, err := strconv.Atoi(strings.TrimSpace(version))
+	if err != nil {
+		return "", fmt.Errorf("physical/file: invalid %q: %v", versionPath, err)
+	}
+	if versionNum > currentFileBackendVersion {
+		return "", fmt.Errorf("physical/file: %q was written by a newer version (format %d, this binary supports up to %d)",
+			b.Path, versionNum, currentFileBackendVersion)
+	}
+
+	idPath := filepath.Join(b.Path, metaDir, "ID")
+	newID, err := randomHex(16)
+	if err != nil {
+		return "", fmt.Errorf("physical/file: failed to generate an ID: %v", err)
+	}
+	id, err := b.readOrCreateFile(idPath, newID)
+	if err != nil {
+		return "", fmt.Errorf("physical/file: failed to read %q: %v", idPath, err)
+	}
+
+	return strings.TrimSpace(id), nil
+}
+
+// readOrCreateFile returns the contents of path, creating it with contents
+// if it doesn't already exist.
+func (b *FileBackend) readOrCreateFile(path, contents string) (string, error) {
+	f, err := b.fs.Open(path)
+	if err == nil {
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	wf, err := b.fs.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer wf.Close()
+
+	if _, err := wf.Write([]byte(contents)); err != nil {
+		return "", err
+	}
+
+	return contents, nil
+}
+
+// ID returns the random identifier generated for this storage directory the
+// first time it was opened, so callers can surface it in diagnostics.
+func (b *FileBackend) ID() string {
+	return b.id
 }
 
 func (b *FileBackend) Delete(path string) error {
@@ -47,15 +211,16 @@ func (b *FileBackend) Delete(path string) error {
 		return nil
 	}
 
-	b.l.Lock()
-	defer b.l.Unlock()
+	lock := b.lockFor(path)
+	lock.Lock()
+	defer lock.Unlock()
 
 	_, fullPathPrefixedFileName, fullPathPrefixedEncodedFileName := b.path(path)
-	err := os.Remove(fullPathPrefixedEncodedFileName)
+	err := b.fs.Remove(fullPathPrefixedEncodedFileName)
 	if err != nil && os.IsNotExist(err) {
 		// For backwards compatibility, try to delete the file without base64
 		// URL encoding the file name.
-		err = os.Remove(fullPathPrefixedFileName)
+		err = b.fs.Remove(fullPathPrefixedFileName)
 	}
 
 	if err != nil && !os.IsNotExist(err) {
@@ -68,31 +233,29 @@ func (b *FileBackend) Delete(path string) error {
 }
 
 // cleanupLogicalPath is used to remove all empty nodes, begining with deepest
-// one, aborting on first non-empty one, up to top-level node.
+// one, aborting on first non-empty one, up to top-level node. It takes the
+// write side of dirLock since it mutates the directory tree and must not
+// race with a concurrent Put recreating the same tree, or with a List
+// walking it.
 func (b *FileBackend) cleanupLogicalPath(path string) error {
+	b.dirLock.Lock()
+	defer b.dirLock.Unlock()
+
 	nodes := strings.Split(path, fmt.Sprintf("%c", os.PathSeparator))
 	for i := len(nodes) - 1; i > 0; i-- {
 		fullPath := filepath.Join(b.Path, filepath.Join(nodes[:i]...))
 
-		dir, err := os.Open(fullPath)
+		list, err := b.fs.ReadDir(fullPath)
 		if err != nil {
 			if os.IsNotExist(err) {
 				return nil
-			} else {
-				return err
 			}
-		}
-
-		list, err := dir.Readdir(1)
-		dir.Close()
-		if err != nil && err != io.EOF {
 			return err
 		}
 
 		// If we have no entries, it's an empty directory; remove it
-		if err == io.EOF || list == nil || len(list) == 0 {
-			err = os.Remove(fullPath)
-			if err != nil {
+		if len(list) == 0 {
+			if err := b.fs.Remove(fullPath); err != nil {
 				return err
 			}
 		}
@@ -102,15 +265,16 @@ func (b *FileBackend) cleanupLogicalPath(path string) error {
 }
 
 func (b *FileBackend) Get(path string) (*Entry, error) {
-	b.l.Lock()
-	defer b.l.Unlock()
+	lock := b.lockFor(path)
+	lock.Lock()
+	defer lock.Unlock()
 
 	_, fullPathPrefixedFileName, fullPathPrefixedEncodedFileName := b.path(path)
-	f, err := os.Open(fullPathPrefixedEncodedFileName)
+	f, err := b.fs.Open(fullPathPrefixedEncodedFileName)
 	if err != nil && os.IsNotExist(err) {
 		// For backwards compatibility, if non-encoded file name is a valid
 		// storage entry, read it out.
-		f, err = os.Open(fullPathPrefixedFileName)
+		f, err = b.fs.Open(fullPathPrefixedFileName)
 	}
 
 	if err != nil {
@@ -121,8 +285,33 @@ func (b *FileBackend) Get(path string) (*Entry, error) {
 	}
 	defer f.Close()
 
+	raw, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var fe fileEntry
+	if err := json.Unmarshal(raw, &fe); err != nil {
+		return nil, err
+	}
+
+	// Old files predate the checksum envelope and hold a plain Entry; decode
+	// them as-is for backward compatibility.
+	if fe.Entry == nil {
+		var entry Entry
+		if err := jsonutil.DecodeJSON(raw, &entry); err != nil {
+			return nil, err
+		}
+		return &entry, nil
+	}
+
+	sum := sha256.Sum256(fe.Entry)
+	if hex.EncodeToString(sum[:]) != fe.SHA256 {
+		return nil, &ErrCorrupt{Key: path}
+	}
+
 	var entry Entry
-	if err := jsonutil.DecodeJSONFromReader(f, &entry); err != nil {
+	if err := jsonutil.DecodeJSON(fe.Entry, &entry); err != nil {
 		return nil, err
 	}
 
@@ -138,58 +327,148 @@ func (b *FileBackend) Put(entry *Entry) error {
 
 	basePath, fullPathPrefixedFileName, fullPathPrefixedEncodedFileName := b.path(entry.Key)
 
-	b.l.Lock()
-	defer b.l.Unlock()
+	lock := b.lockFor(entry.Key)
+	lock.Lock()
+	defer lock.Unlock()
 
 	// New storage entries will have their file names base64 URL encoded. If a
 	// file with a non-encoded file name exists, it indicates that this is an
-	// update operation. To avoid duplication of storage entries, delete the
-	// old entry in the defer function.
-	info, err := os.Stat(fullPathPrefixedFileName)
-	if err == nil && info != nil {
-		defer func() {
-			err := os.Remove(fullPathPrefixedFileName)
-			if err != nil && !os.IsNotExist(err) {
-				retErr = multierror.Append(retErr, fmt.Errorf("failed to remove old entry: %v", err))
-				return
-			}
-			err = b.cleanupLogicalPath(entry.Key)
-			if err != nil {
-				retErr = multierror.Append(retErr, fmt.Errorf("failed to cleanup the after removing old entry: %v", err))
-				return
-			}
-		}()
+	// update operation. Only delete the old entry once the new one is safely
+	// in place below: removing it any earlier means a failed Put (disk full,
+	// permission error, anything past this point) would destroy the caller's
+	// only copy of the data instead of leaving it untouched.
+	_, statErr := b.fs.Stat(fullPathPrefixedFileName)
+	hasOldEntry := statErr == nil
+
+	// Make the parent tree and write the entry into it under the read side of
+	// dirLock: concurrent Puts to distinct subtrees don't conflict with each
+	// other, only with a cleanupLogicalPath removing a tree out from under a
+	// Put that is still populating it. The lock is held across the whole
+	// write+rename below, not just the MkdirAll, but it must be released
+	// before the hasOldEntry cleanup further down: cleanupLogicalPath takes
+	// the write side of this same mutex, and RLock does not nest with a
+	// synchronous Lock on the same goroutine.
+	b.dirLock.RLock()
+
+	if err := b.fs.MkdirAll(basePath, 0755); err != nil {
+		b.dirLock.RUnlock()
+		retErr = multierror.Append(retErr, err)
+		return retErr
 	}
 
-	// Make the parent tree
-	if err := os.MkdirAll(basePath, 0755); err != nil {
+	// Write the entry to a temp file in the same directory and fsync it, then
+	// atomically rename it over the destination and fsync the parent
+	// directory. This way a crash or power loss can only ever observe the old
+	// file or the new one, never a truncated or half-written one. Both the
+	// temp file and the rename go through b.fs, like every other path in this
+	// function, so they also get Windows long-path handling.
+	suffix, err := randomSuffix()
+	if err != nil {
+		b.dirLock.RUnlock()
 		retErr = multierror.Append(retErr, err)
 		return retErr
 	}
-
-	// JSON encode the entry and write it
-	f, err := os.OpenFile(
-		fullPathPrefixedEncodedFileName,
-		os.O_CREATE|os.O_TRUNC|os.O_WRONLY,
-		0600)
+	tmpPath := filepath.Join(basePath, "_"+filepath.Base(fullPathPrefixedEncodedFileName)+tmpFileInfix+suffix)
+	tmpFile, err := b.fs.OpenFile(tmpPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
 	if err != nil {
+		b.dirLock.RUnlock()
 		retErr = multierror.Append(retErr, err)
 		return retErr
 	}
-	defer f.Close()
-	enc := json.NewEncoder(f)
+	defer b.fs.Remove(tmpPath) // no-op once the rename below has succeeded
 
-	err = enc.Encode(entry)
+	entryJSON, err := json.Marshal(entry)
 	if err != nil {
+		tmpFile.Close()
+		b.dirLock.RUnlock()
 		retErr = multierror.Append(retErr, err)
 		return retErr
 	}
-	return nil
+	sum := sha256.Sum256(entryJSON)
+	fe := fileEntry{SHA256: hex.EncodeToString(sum[:]), Entry: entryJSON}
+
+	if err := json.NewEncoder(tmpFile).Encode(&fe); err != nil {
+		tmpFile.Close()
+		b.dirLock.RUnlock()
+		retErr = multierror.Append(retErr, err)
+		return retErr
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		b.dirLock.RUnlock()
+		retErr = multierror.Append(retErr, err)
+		return retErr
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		b.dirLock.RUnlock()
+		retErr = multierror.Append(retErr, err)
+		return retErr
+	}
+
+	if err := b.fs.Rename(tmpPath, fullPathPrefixedEncodedFileName); err != nil {
+		b.dirLock.RUnlock()
+		retErr = multierror.Append(retErr, err)
+		return retErr
+	}
+
+	if err := b.syncDir(basePath); err != nil {
+		b.dirLock.RUnlock()
+		retErr = multierror.Append(retErr, err)
+		return retErr
+	}
+
+	b.dirLock.RUnlock()
+
+	// The new entry is durably in place; it's now safe to remove the old
+	// non-encoded entry this Put superseded, to avoid duplicate storage
+	// entries for the same key.
+	if hasOldEntry {
+		if err := b.fs.Remove(fullPathPrefixedFileName); err != nil && !os.IsNotExist(err) {
+			retErr = multierror.Append(retErr, fmt.Errorf("failed to remove old entry: %v", err))
+			return retErr
+		}
+		if err := b.cleanupLogicalPath(entry.Key); err != nil {
+			retErr = multierror.Append(retErr, fmt.Errorf("failed to cleanup after removing old entry: %v", err))
+			return retErr
+		}
+	}
+
+	return retErr
+}
+
+// randomHex returns n random bytes, hex-encoded, or an error if the entropy
+// source can't be read.
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("physical/file: failed to read random bytes: %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// randomSuffix returns a short random hex string used to make temp file
+// names unique.
+func randomSuffix() (string, error) {
+	return randomHex(8)
+}
+
+// syncDir fsyncs the directory itself so that a preceding rename within it is
+// durable: on Linux, a rename is not guaranteed to survive a crash until the
+// parent directory's metadata has also been flushed to disk.
+func (b *FileBackend) syncDir(path string) error {
+	d, err := b.fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
 
 func (b *FileBackend) List(prefix string) ([]string, error) {
-	b.l.Lock()
-	defer b.l.Unlock()
+	b.dirLock.RLock()
+	defer b.dirLock.RUnlock()
 
 	path := b.Path
 	if prefix != "" {
@@ -197,7 +476,7 @@ func (b *FileBackend) List(prefix string) ([]string, error) {
 	}
 
 	// Read the directory contents
-	f, err := os.Open(path)
+	infos, err := b.fs.ReadDir(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, nil
@@ -205,30 +484,74 @@ func (b *FileBackend) List(prefix string) ([]string, error) {
 
 		return nil, err
 	}
-	defer f.Close()
 
-	names, err := f.Readdirnames(-1)
-	if err != nil {
-		return nil, err
-	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		name := info.Name()
+		if prefix == "" && name == metaDir {
+			// Reserved for VERSION/ID, not a logical entry.
+			continue
+		}
+		if strings.Contains(name, tmpFileInfix) {
+			// Leftover from a Put that was interrupted before its rename;
+			// not a logical entry.
+			continue
+		}
 
-	for i, name := range names {
 		if name[0] == '_' {
-			names[i] = name[1:]
+			name = name[1:]
 			// If the file name is encoded, decode it to retain the list output
 			// meaningful.
-			nameDecodedBytes, err := base64.URLEncoding.DecodeString(names[i])
+			nameDecodedBytes, err := base64.URLEncoding.DecodeString(name)
 			if err == nil {
-				names[i] = string(nameDecodedBytes)
+				name = string(nameDecodedBytes)
 			}
 		} else {
-			names[i] = name + "/"
+			name = name + "/"
 		}
+
+		names = append(names, name)
 	}
 
 	return names, nil
 }
 
+// Verify walks every entry at or below prefix and recomputes its checksum,
+// without mutating anything, returning the logical keys of any entries whose
+// stored checksum doesn't match their content. Entries written before the
+// checksum envelope was introduced are assumed good, since they carry no
+// checksum to check.
+func (b *FileBackend) Verify(prefix string) ([]string, error) {
+	names, err := b.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var corrupt []string
+	for _, name := range names {
+		key := filepath.Join(prefix, strings.TrimSuffix(name, "/"))
+
+		if strings.HasSuffix(name, "/") {
+			sub, err := b.Verify(key)
+			if err != nil {
+				return nil, err
+			}
+			corrupt = append(corrupt, sub...)
+			continue
+		}
+
+		if _, err := b.Get(key); err != nil {
+			if _, ok := err.(*ErrCorrupt); ok {
+				corrupt = append(corrupt, key)
+				continue
+			}
+			return nil, err
+		}
+	}
+
+	return corrupt, nil
+}
+
 func (b *FileBackend) path(path string) (string, string, string) {
 	fullPath := filepath.Join(b.Path, path)
 
@@ -0,0 +1,44 @@
+// Package fs abstracts the filesystem calls FileBackend needs behind a small
+// interface, so that platform-specific path handling can be swapped in
+// without touching the backend logic. The motivating case is Windows, where
+// a path longer than MAX_PATH (260 characters) is rejected by the stdlib
+// unless it has been converted to its extended-length \\?\ form; see
+// fs_windows.go.
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// FS is the set of filesystem operations FileBackend performs. Implementations
+// must behave like their os/ioutil counterparts of the same name.
+type FS interface {
+	Open(name string) (*os.File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (*os.File, error)
+	Stat(name string) (os.FileInfo, error)
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	MkdirAll(path string, perm os.FileMode) error
+	ReadDir(dirname string) ([]os.FileInfo, error)
+}
+
+// osFS is the default FS, delegating straight to the os and ioutil packages.
+// It is used as-is on every platform except Windows.
+type osFS struct{}
+
+func (osFS) Open(name string) (*os.File, error) { return os.Open(name) }
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) { return os.Stat(name) }
+
+func (osFS) Remove(name string) error { return os.Remove(name) }
+
+func (osFS) Rename(oldpath, newpath string) error { return os.Rename(oldpath, newpath) }
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+
+func (osFS) ReadDir(dirname string) ([]os.FileInfo, error) { return ioutil.ReadDir(dirname) }
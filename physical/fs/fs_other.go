@@ -0,0 +1,8 @@
+// +build !windows
+
+package fs
+
+// New returns the default, OS-backed FS for the current platform.
+func New() FS {
+	return osFS{}
+}
@@ -0,0 +1,115 @@
+// +build windows
+
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// New returns an FS that rewrites every path to its \\?\-prefixed extended-length
+// form before delegating to the stdlib, so that paths longer than MAX_PATH
+// (260 characters) keep working. Vault logical paths are joined under
+// FileBackend.Path and then base64-encoded, which makes this easy to hit.
+func New() FS {
+	return windowsFS{}
+}
+
+type windowsFS struct{}
+
+func (windowsFS) Open(name string) (*os.File, error) {
+	p, err := extendedLengthPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (windowsFS) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	p, err := extendedLengthPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, flag, perm)
+}
+
+func (windowsFS) Stat(name string) (os.FileInfo, error) {
+	p, err := extendedLengthPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (windowsFS) Remove(name string) error {
+	p, err := extendedLengthPath(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (windowsFS) Rename(oldpath, newpath string) error {
+	oldp, err := extendedLengthPath(oldpath)
+	if err != nil {
+		return err
+	}
+	newp, err := extendedLengthPath(newpath)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldp, newp)
+}
+
+func (windowsFS) MkdirAll(path string, perm os.FileMode) error {
+	p, err := extendedLengthPath(path)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, perm)
+}
+
+func (windowsFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	p, err := extendedLengthPath(dirname)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	list, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+// extendedLengthPath converts path to an absolute, backslash-separated path
+// prefixed with \\?\ (or \\?\UNC\ for a UNC share), which tells the Windows
+// API to bypass the 260-character MAX_PATH limit.
+func extendedLengthPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("fs: failed to make %q absolute: %v", path, err)
+	}
+
+	abs = strings.Replace(abs, "/", `\`, -1)
+
+	switch {
+	case strings.HasPrefix(abs, `\\?\`):
+		return abs, nil
+	case strings.HasPrefix(abs, `\\`):
+		return `\\?\UNC\` + abs[2:], nil
+	default:
+		return `\\?\` + abs, nil
+	}
+}